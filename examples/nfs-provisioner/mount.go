@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	linuxproc "github.com/c9s/goprocinfo/linux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	glog "k8s.io/klog"
+)
+
+const (
+	// mountAttemptTimeout bounds a single `mount` invocation so a wedged
+	// NFS server can't block Provision/Delete forever.
+	mountAttemptTimeout = 30 * time.Second
+	mountMaxAttempts    = 4
+	mountBackoffBase    = 2 * time.Second
+)
+
+var (
+	mountAttemptsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nfs_provisioner_mount_attempts_total",
+		Help: "Number of times the provisioner has attempted to mount an NFS export.",
+	})
+	mountFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nfs_provisioner_mount_failures_total",
+		Help: "Number of NFS mount attempts that ultimately failed after retries.",
+	})
+	mountsCurrent = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "nfs_provisioner_mounts_current",
+		Help: "Number of NFS exports currently tracked as mounted by this instance.",
+	})
+)
+
+// mountRunner abstracts running the mount/umount commands so MountManager
+// can be unit tested without root or a real NFS server, mirroring cmdRunner
+// in quota.go.
+type mountRunner interface {
+	Mount(ctx context.Context, server string, path string, mp string) ([]byte, error)
+	Unmount(mp string) ([]byte, error)
+}
+
+type execMountRunner struct{}
+
+func (execMountRunner) Mount(ctx context.Context, server string, path string, mp string) ([]byte, error) {
+	// has to be deployed as priviliged container
+	return exec.CommandContext(ctx, "mount", fmt.Sprintf("%s:%s", server, path), mp).CombinedOutput()
+}
+
+func (execMountRunner) Unmount(mp string) ([]byte, error) {
+	return exec.Command("umount", "-l", mp).CombinedOutput()
+}
+
+// MountManager owns every NFS mount this provisioner instance has made. It
+// retries transient mount failures with a timeout and backoff, tracks
+// active mount points so they can be cleanly unmounted on shutdown, and can
+// reconcile its view of the world against /proc/mounts on startup so a
+// restarted provisioner doesn't leak or re-mount existing mounts.
+type MountManager struct {
+	runner mountRunner
+
+	mu     sync.Mutex
+	mounts map[string]struct{}
+}
+
+// NewMountManager returns an empty MountManager. Call Reconcile once at
+// startup to pick up mounts left behind by a previous process.
+func NewMountManager() *MountManager {
+	return &MountManager{runner: execMountRunner{}, mounts: map[string]struct{}{}}
+}
+
+// Reconcile populates the manager's view of active mounts from
+// /proc/mounts, so mounts made by a previous instance of the provisioner
+// (e.g. before a pod restart) are tracked for unmounting rather than
+// leaked.
+func (m *MountManager) Reconcile() error {
+	mounts, err := linuxproc.ReadMounts("/proc/mounts")
+	if err != nil {
+		return fmt.Errorf("unable to read /proc/mounts: %v", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mnt := range mounts.Mounts {
+		if isUnderMountPath(mnt.MountPoint) {
+			m.mounts[mnt.MountPoint] = struct{}{}
+		}
+	}
+	mountsCurrent.Set(float64(len(m.mounts)))
+	return nil
+}
+
+func isUnderMountPath(mp string) bool {
+	return strings.HasPrefix(mp, mountPath+"/")
+}
+
+func (m *MountManager) isMounted(mp string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.mounts[mp]
+	return ok
+}
+
+func (m *MountManager) track(mp string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mounts[mp] = struct{}{}
+	mountsCurrent.Set(float64(len(m.mounts)))
+}
+
+func (m *MountManager) untrack(mp string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mounts, mp)
+	mountsCurrent.Set(float64(len(m.mounts)))
+}
+
+// EnsureMount mounts server:path under mountPath, retrying transient
+// failures with a timeout and exponential backoff. It is a no-op if the
+// export is already tracked as mounted.
+func (m *MountManager) EnsureMount(server string, path string) (string, error) {
+	mp := mountPoint(server, path)
+	if m.isMounted(mp) {
+		return mp, nil
+	}
+	if err := os.MkdirAll(mp, 0777); err != nil {
+		return mp, err
+	}
+
+	var lastErr error
+	backoff := mountBackoffBase
+	for attempt := 0; attempt < mountMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		mountAttemptsTotal.Inc()
+		ctx, cancel := context.WithTimeout(context.Background(), mountAttemptTimeout)
+		out, err := m.runner.Mount(ctx, server, path, mp)
+		cancel()
+		if err == nil {
+			m.track(mp)
+			return mp, nil
+		}
+		lastErr = fmt.Errorf("mount attempt %d/%d failed: %v (%s)", attempt+1, mountMaxAttempts, err, out)
+		glog.Warning(lastErr)
+	}
+	mountFailuresTotal.Inc()
+	return mp, lastErr
+}
+
+// UnmountAll lazily unmounts every mount point this manager has tracked.
+// It's intended to run on shutdown so mounts don't leak across restarts.
+func (m *MountManager) UnmountAll() {
+	m.mu.Lock()
+	mps := make([]string, 0, len(m.mounts))
+	for mp := range m.mounts {
+		mps = append(mps, mp)
+	}
+	m.mu.Unlock()
+
+	for _, mp := range mps {
+		if out, err := m.runner.Unmount(mp); err != nil {
+			glog.Errorf("failed to unmount %s: %v (%s)", mp, err, out)
+			continue
+		}
+		m.untrack(mp)
+	}
+}
+
+func mountPoint(server string, path string) string {
+	return fmt.Sprintf("%s/%s/%s", mountPath, server, url.QueryEscape(path))
+}
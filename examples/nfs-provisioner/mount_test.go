@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// fakeMountRunner records mount/unmount invocations and returns canned
+// results, mirroring fakeCmdRunner in quota_test.go.
+type fakeMountRunner struct {
+	mountCalls   int
+	mountErr     error
+	unmountCalls []string
+	unmountErr   error
+}
+
+func (f *fakeMountRunner) Mount(ctx context.Context, server string, path string, mp string) ([]byte, error) {
+	f.mountCalls++
+	return []byte("ok"), f.mountErr
+}
+
+func (f *fakeMountRunner) Unmount(mp string) ([]byte, error) {
+	f.unmountCalls = append(f.unmountCalls, mp)
+	return []byte("ok"), f.unmountErr
+}
+
+func TestIsUnderMountPath(t *testing.T) {
+	cases := []struct {
+		mp   string
+		want bool
+	}{
+		{mountPath + "/server1/vol1", true},
+		{mountPath, false},
+		{mountPath + "foo", false},
+		{"/etc", false},
+	}
+	for _, c := range cases {
+		if got := isUnderMountPath(c.mp); got != c.want {
+			t.Errorf("isUnderMountPath(%q) = %v, want %v", c.mp, got, c.want)
+		}
+	}
+}
+
+func TestEnsureMountIsNoopWhenAlreadyTracked(t *testing.T) {
+	runner := &fakeMountRunner{}
+	mp := mountPoint("server1", "/export")
+	m := &MountManager{runner: runner, mounts: map[string]struct{}{mp: {}}}
+
+	got, err := m.EnsureMount("server1", "/export")
+	if err != nil {
+		t.Fatalf("EnsureMount: unexpected error: %v", err)
+	}
+	if got != mp {
+		t.Errorf("EnsureMount: got mountpoint %q, want %q", got, mp)
+	}
+	if runner.mountCalls != 0 {
+		t.Errorf("EnsureMount: expected the already-tracked mount to be reused, got %d mount attempts", runner.mountCalls)
+	}
+}
+
+func TestUnmountAllUntracksOnSuccess(t *testing.T) {
+	runner := &fakeMountRunner{}
+	mp := mountPoint("server1", "/export")
+	m := &MountManager{runner: runner, mounts: map[string]struct{}{}}
+	m.track(mp)
+
+	m.UnmountAll()
+
+	if len(runner.unmountCalls) != 1 || runner.unmountCalls[0] != mp {
+		t.Fatalf("UnmountAll: expected a single umount call for %q, got %v", mp, runner.unmountCalls)
+	}
+	if m.isMounted(mp) {
+		t.Errorf("UnmountAll: expected %q to be untracked after a successful umount", mp)
+	}
+}
+
+func TestUnmountAllKeepsTrackingOnFailure(t *testing.T) {
+	runner := &fakeMountRunner{unmountErr: fmt.Errorf("boom")}
+	mp := mountPoint("server1", "/export")
+	m := &MountManager{runner: runner, mounts: map[string]struct{}{}}
+	m.track(mp)
+
+	m.UnmountAll()
+
+	if !m.isMounted(mp) {
+		t.Errorf("UnmountAll: expected %q to remain tracked after a failed umount", mp)
+	}
+}
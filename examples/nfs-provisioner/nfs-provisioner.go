@@ -4,28 +4,127 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	linuxproc "github.com/c9s/goprocinfo/linux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/ioutil"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	glog "k8s.io/klog"
-	"net/url"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/controller"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
 	provisionerNameKey = "PROVISIONER_NAME"
+
+	// nfsProvisionerIdentity is the annotation put on a PV to record which
+	// instance of the provisioner created it. Delete() refuses to act on a
+	// PV whose identity doesn't match its own so that two replicas racing
+	// on the same PV never double-delete or cross-delete each other's work.
+	nfsProvisionerIdentity = "nfsProvisionerIdentity"
+
+	// nfsProvisionerOnDelete and nfsProvisionerArchivePrefix record the
+	// StorageClass's onDelete/archivePrefix parameters at provision time, so
+	// that Delete() behaves consistently even if the StorageClass was
+	// edited or removed in the meantime.
+	nfsProvisionerOnDelete      = "nfsProvisionerOnDelete"
+	nfsProvisionerArchivePrefix = "nfsProvisionerArchivePrefix"
+
+	// nfsProvisionerQuota records which quota backend provisioned a PV, so
+	// that Delete() knows how to interpret nfsProvisionerProjectID.
+	nfsProvisionerQuota = "nfsProvisionerQuota"
+
+	// nfsProvisionerExportPath and nfsProvisionerSubPath record, respectively,
+	// the StorageClass's nfsPath and the expanded pathPattern subdirectory
+	// used at provision time. Delete() needs both to rebuild the exact local
+	// directory a PV owns; deriving it from volume.Spec...NFS.Path with
+	// path.Dir() silently truncates multi-segment subPaths and risks
+	// operating on a shared parent directory instead.
+	nfsProvisionerExportPath = "nfsProvisionerExportPath"
+	nfsProvisionerSubPath    = "nfsProvisionerSubPath"
+
+	// defaultPathPattern lays PVs out as <namespace>/<pvc-name>-<pv-name>,
+	// which keeps dynamically provisioned directories human-discoverable
+	// on the export without requiring any Wise2C-specific PVC labels.
+	defaultPathPattern   = "${.PVC.Namespace}/${.PVC.Name}-${.PV.Name}"
+	defaultArchivePrefix = "archived"
+
+	onDeleteDelete  = "delete"
+	onDeleteRetain  = "retain"
+	onDeleteArchive = "archive"
+)
+
+// pathPatternToken matches the `${.PVC.Namespace}`-style tokens supported by
+// the pathPattern StorageClass parameter.
+var pathPatternToken = regexp.MustCompile(`\$\{\.([A-Za-z]+)\.([A-Za-z0-9]+)\}`)
+
+var (
+	leaderElection          = flag.Bool("leader-election", false, "Enables leader election, so that only one instance of this provisioner is actively provisioning/deleting volumes at a time. Required when running more than one replica.")
+	leaderElectionNamespace = flag.String("leader-election-namespace", "", "Namespace in which to create the leader election lock. Defaults to the pod's own namespace.")
+	metricsAddr             = flag.String("metrics-addr", ":8080", "Address to serve Prometheus metrics on.")
 )
 
 type nfsProvisioner struct {
 	client kubernetes.Interface
+	// identity is a unique id stamped on every PV this instance provisions,
+	// so that Delete() can tell its own PVs apart from a peer replica's.
+	identity types.UID
+	// quotaRunner executes the external commands quota enforcers need
+	// (xfs_quota, du). It's swapped out in tests.
+	quotaRunner cmdRunner
+	// quotaEnforcers holds one quotaEnforcer per "quota" StorageClass
+	// parameter value, lazily created and then reused for the life of this
+	// instance. Enforcers carry state (xfsProjectEnforcer.nextID,
+	// fakeEnforcer.stops) that Enforce and Release both need to see, so a
+	// fresh enforcer per Provision/Delete call would lose it.
+	quotaEnforcers   map[string]quotaEnforcer
+	quotaEnforcersMu sync.Mutex
+	// mounts tracks and retries this instance's NFS mounts.
+	mounts *MountManager
+	// serverMinor is the Kubernetes apiserver's minor version, used to
+	// reject access modes the cluster doesn't understand yet.
+	serverMinor int
+}
+
+// quotaEnforcerFor returns the shared quotaEnforcer for kind, creating it on
+// first use. Provision and Delete must go through this rather than calling
+// newQuotaEnforcer directly, so that Release sees the same enforcer state
+// (allocated project ids, in-flight poll goroutines) that Enforce set up.
+func (p *nfsProvisioner) quotaEnforcerFor(kind string) (quotaEnforcer, error) {
+	p.quotaEnforcersMu.Lock()
+	defer p.quotaEnforcersMu.Unlock()
+	if e, ok := p.quotaEnforcers[kind]; ok {
+		return e, nil
+	}
+	e, err := newQuotaEnforcer(kind, p.quotaRunner)
+	if err != nil {
+		return nil, err
+	}
+	if xe, ok := e.(*xfsProjectEnforcer); ok {
+		maxID, err := reconcileXFSProjectIDs(p.client)
+		if err != nil {
+			return nil, err
+		}
+		xe.nextID = maxID
+	}
+	if p.quotaEnforcers == nil {
+		p.quotaEnforcers = map[string]quotaEnforcer{}
+	}
+	p.quotaEnforcers[kind] = e
+	return e, nil
 }
 
 const (
@@ -39,74 +138,138 @@ func inMap(key string, m map[string]string) bool {
 	return ok
 }
 
-func pvName(tenant string, stack string, service string, name string) string {
-	return fmt.Sprintf("%s-%s-%s-%s", tenant, stack, service, name)
-}
-
-func isMounted(mp string) bool {
-	mps, err := linuxproc.ReadMounts("/proc/mounts")
-	if err != nil {
-		return false
-	}
-	for _, m := range mps.Mounts {
-		if m.MountPoint == mp {
-			return true
+// expandPathPattern expands `${.PVC.Namespace}`, `${.PVC.Name}` and
+// `${.PV.Name}` tokens in pattern using the given provision options,
+// producing the exported subdirectory path for a PV. `${.PVC.Annotations.foo}`
+// tokens are not handled here; subPath expands them first with
+// expandPathPatternPVCAnnotations. Unknown tokens are left untouched so typos
+// are easy to spot on the export rather than silently swallowed.
+func expandPathPattern(pattern string, options controller.ProvisionOptions) string {
+	return pathPatternToken.ReplaceAllStringFunc(pattern, func(tok string) string {
+		m := pathPatternToken.FindStringSubmatch(tok)
+		switch m[1] {
+		case "PVC":
+			switch m[2] {
+			case "Namespace":
+				return options.PVC.Namespace
+			case "Name":
+				return options.PVC.Name
+			}
+		case "PV":
+			switch m[2] {
+			case "Name":
+				return options.PVName
+			}
 		}
-	}
-	return false
+		return tok
+	})
 }
 
-func mountPoint(server string, path string) string {
-	return fmt.Sprintf("%s/%s/%s", mountPath, server, url.QueryEscape(path))
+// expandPathPatternPVCAnnotations handles the `${.PVC.Annotations.foo}`
+// token, which needs the annotation key rather than a fixed field name and
+// so doesn't fit the simple two-segment token switch above.
+var pvcAnnotationToken = regexp.MustCompile(`\$\{\.PVC\.Annotations\.([^}]+)\}`)
+
+func expandPathPatternPVCAnnotations(pattern string, options controller.ProvisionOptions) string {
+	return pvcAnnotationToken.ReplaceAllStringFunc(pattern, func(tok string) string {
+		m := pvcAnnotationToken.FindStringSubmatch(tok)
+		return options.PVC.Annotations[m[1]]
+	})
 }
 
-func ensureMount(server string, path string) (string, error) {
-	mp := mountPoint(server, path)
-	if isMounted(mp) {
-		return mp, nil
+func subPath(options controller.ProvisionOptions) string {
+	pattern := options.StorageClass.Parameters["pathPattern"]
+	if pattern == "" {
+		pattern = defaultPathPattern
 	}
-	if err := os.MkdirAll(mp, 0777); err != nil {
-		return mp, err
+	pattern = expandPathPatternPVCAnnotations(pattern, options)
+	return expandPathPattern(pattern, options)
+}
+
+// safeJoin joins mp and subPath and verifies the result is still contained
+// within mp. subPath can come from a pathPattern StorageClass parameter that
+// echoes back PVC annotations - fully attacker-controlled by whoever can
+// create or edit the PVC - so a naive filepath.Join would let a "../../etc"
+// annotation make Provision/Delete operate outside the NFS export entirely.
+func safeJoin(mp string, subPath string) (string, error) {
+	joined := filepath.Join(mp, subPath)
+	root := filepath.Clean(mp)
+	if joined != root && !strings.HasPrefix(joined, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("subPath %q escapes export root %q", subPath, mp)
 	}
-	// has to be deployed as priviliged container
-	cmd := exec.Command("mount", fmt.Sprintf("%s:%s", server, path), mp)
-	return mp, cmd.Run()
+	return joined, nil
 }
 
 // Provision creates a storage asset and returns a PV object representing it.
 func (p *nfsProvisioner) Provision(options controller.ProvisionOptions) (*v1.PersistentVolume, error) {
 	params := options.StorageClass.Parameters
-	if !(inMap("nfsPath", params) && inMap("nfsServer", params)) {
-		return nil, fmt.Errorf("nfsPath and nfsServer parameters required")
+	if err := validateAccessModes(options.PVC.Spec.AccessModes, p.serverMinor); err != nil {
+		return nil, err
 	}
-	server := params["nfsServer"]
-	path := params["nfsPath"]
-	mp, err := ensureMount(server, path)
+	server, path, err := resolveServerAndPath(options)
+	if err != nil {
+		return nil, err
+	}
+	mp, err := p.mounts.EnsureMount(server, path)
 	if err != nil {
 		return nil, fmt.Errorf("unable to mount NFS volume: " + err.Error())
 	}
-	tenant := options.PVC.Labels["io.wise2c.tenant"]
-	stack := options.PVC.Labels["io.wise2c.stack"]
-	service := options.PVC.Labels["io.wise2c.service"]
-	pvName := pvName(tenant, stack, service, options.PVName)
-	if err := os.MkdirAll(filepath.Join(mp, options.PVName), 0777); err != nil {
+
+	onDelete := params["onDelete"]
+	if onDelete == "" {
+		onDelete = onDeleteDelete
+	}
+	if onDelete != onDeleteDelete && onDelete != onDeleteRetain && onDelete != onDeleteArchive {
+		return nil, fmt.Errorf("invalid onDelete parameter %q: must be one of %s, %s, %s", onDelete, onDeleteDelete, onDeleteRetain, onDeleteArchive)
+	}
+	archivePrefix := params["archivePrefix"]
+	if archivePrefix == "" {
+		archivePrefix = defaultArchivePrefix
+	}
+
+	pvSubPath := subPath(options)
+	pvPath, err := safeJoin(mp, pvSubPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(pvPath, 0777); err != nil {
 		return nil, errors.New("unable to create directory to provision new pv: " + err.Error())
 	}
 
+	quotaKind := params["quota"]
+	enforcer, err := p.quotaEnforcerFor(quotaKind)
+	if err != nil {
+		return nil, err
+	}
+	projectID, err := enforcer.Enforce(mp, pvPath, options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)])
+	if err != nil {
+		return nil, fmt.Errorf("unable to enforce quota: %v", err)
+	}
+
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: options.PVName,
+			Annotations: map[string]string{
+				nfsProvisionerIdentity:      string(p.identity),
+				nfsProvisionerOnDelete:      onDelete,
+				nfsProvisionerArchivePrefix: archivePrefix,
+				nfsProvisionerQuota:         quotaKind,
+				nfsProvisionerProjectID:     projectID,
+				nfsProvisionerExportPath:    path,
+				nfsProvisionerSubPath:       pvSubPath,
+			},
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
 			AccessModes:                   options.PVC.Spec.AccessModes,
+			NodeAffinity:                  volumeNodeAffinity(options),
 			Capacity: v1.ResourceList{
 				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 				NFS: &v1.NFSVolumeSource{
 					Server:   server,
-					Path:     filepath.Join(path, pvName),
+					Path:     filepath.Join(path, pvSubPath),
 					ReadOnly: false,
 				},
 			},
@@ -119,26 +282,84 @@ func (p *nfsProvisioner) Provision(options controller.ProvisionOptions) (*v1.Per
 // Delete removes the storage asset that was created by Provision represented
 // by the given PV.
 func (p *nfsProvisioner) Delete(volume *v1.PersistentVolume) error {
-	//ann, ok := volume.Annotations["hostPathProvisionerIdentity"]
-	//if !ok {
-	//	return errors.New("identity annotation not found on PV")
-	//}
-	//if ann != p.identity {
-	//	return &controller.IgnoredError{Reason: "identity annotation on PV does not match ours"}
-	//}
+	ann, ok := volume.Annotations[nfsProvisionerIdentity]
+	if !ok {
+		return &controller.IgnoredError{Reason: "identity annotation not found on PV"}
+	}
+	if ann != string(p.identity) {
+		return &controller.IgnoredError{Reason: "identity annotation on PV does not match ours"}
+	}
+
+	if volume.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain {
+		return nil
+	}
 
 	server := volume.Spec.PersistentVolumeSource.NFS.Server
-	// Path include the dynamic volume name
-	path := path.Dir(volume.Spec.PersistentVolumeSource.NFS.Path)
-	mp, err := ensureMount(server, path)
+	exportPath := volume.Annotations[nfsProvisionerExportPath]
+	pvSubPath := volume.Annotations[nfsProvisionerSubPath]
+	if exportPath == "" || pvSubPath == "" {
+		// Pre-subPath-tokens PV: fall back to the old scheme, where the
+		// subdirectory was always exactly the last path segment.
+		exportPath = path.Dir(volume.Spec.PersistentVolumeSource.NFS.Path)
+		pvSubPath = filepath.Base(volume.Spec.PersistentVolumeSource.NFS.Path)
+	}
+	mp, err := p.mounts.EnsureMount(server, exportPath)
 	if err != nil {
-		glog.Errorf("Failed to mount %s:%s %s", server, path, mp)
+		glog.Errorf("Failed to mount %s:%s %s", server, exportPath, mp)
 		return err
 	}
-	if err := os.RemoveAll(path); err != nil {
+	pvDir, err := safeJoin(mp, pvSubPath)
+	if err != nil {
 		return err
 	}
 
+	if enforcer, err := p.quotaEnforcerFor(volume.Annotations[nfsProvisionerQuota]); err != nil {
+		glog.Errorf("unable to construct quota enforcer for %s: %v", pvDir, err)
+	} else if err := enforcer.Release(mp, pvDir, volume.Annotations[nfsProvisionerProjectID]); err != nil {
+		glog.Errorf("unable to release quota for %s: %v", pvDir, err)
+	}
+
+	archivePrefix := volume.Annotations[nfsProvisionerArchivePrefix]
+	if archivePrefix == "" {
+		archivePrefix = defaultArchivePrefix
+	}
+	return disposeVolumeDir(volume.Spec.PersistentVolumeReclaimPolicy, volume.Annotations[nfsProvisionerOnDelete], archivePrefix, pvDir)
+}
+
+// disposeVolumeDir applies the given PV's reclaim policy (and, for
+// PersistentVolumeReclaimDelete, its finer-grained onDelete StorageClass
+// setting) to pvDir. Retain is handled by the caller before a mount is even
+// attempted; this only has to choose between Recycle and Delete's
+// delete/retain/archive variants.
+func disposeVolumeDir(reclaimPolicy v1.PersistentVolumeReclaimPolicy, onDelete string, archivePrefix string, pvDir string) error {
+	if reclaimPolicy == v1.PersistentVolumeReclaimRecycle {
+		return removeContents(pvDir)
+	}
+
+	switch onDelete {
+	case onDeleteRetain:
+		return nil
+	case onDeleteArchive:
+		archivedPath := filepath.Join(filepath.Dir(pvDir), fmt.Sprintf("%s-%d-%s", archivePrefix, time.Now().Unix(), filepath.Base(pvDir)))
+		return os.Rename(pvDir, archivedPath)
+	default:
+		return os.RemoveAll(pvDir)
+	}
+}
+
+// removeContents deletes everything inside dir but leaves dir itself in
+// place, for the Recycle reclaim policy where the PV is meant to be reused
+// once wiped.
+func removeContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -171,12 +392,52 @@ func main() {
 		glog.Fatalf("Error getting server version: %v", err)
 	}
 
+	http.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(*metricsAddr, nil); err != nil {
+			glog.Errorf("metrics server exited: %v", err)
+		}
+	}()
+
+	mounts := NewMountManager()
+	if err := mounts.Reconcile(); err != nil {
+		glog.Errorf("unable to reconcile existing mounts, starting with an empty view: %v", err)
+	}
+
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
-	clientNFSProvisioner := &nfsProvisioner{}
+	clientNFSProvisioner := &nfsProvisioner{
+		client:      clientset,
+		identity:    uuid.NewUUID(),
+		quotaRunner: execCmdRunner{},
+		mounts:      mounts,
+		serverMinor: parseMinorVersion(serverVersion.Minor),
+	}
+
+	// Lazily unmount everything we know about before the process exits, so
+	// mounts don't leak across pod restarts.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		glog.Infof("received %v, unmounting tracked NFS exports", sig)
+		mounts.UnmountAll()
+		os.Exit(0)
+	}()
 
-	// Start the provision controller which will dynamically provision hostPath
-	// PVs
-	pc := controller.NewProvisionController(clientset, provisionerName, clientNFSProvisioner, serverVersion.GitVersion)
+	// Start the provision controller which will dynamically provision NFS
+	// PVs. With leader election enabled, it's safe to run this as a
+	// Deployment with more than one replica: only the elected leader will
+	// be actively provisioning/deleting at any given time. The lock's name
+	// is derived by the library from provisionerName; it isn't independently
+	// configurable.
+	pc := controller.NewProvisionController(
+		clientset,
+		provisionerName,
+		clientNFSProvisioner,
+		serverVersion.GitVersion,
+		controller.LeaderElection(*leaderElection),
+		controller.LeaderElectionNamespace(*leaderElectionNamespace),
+	)
 	pc.Run(wait.NeverStop)
 }
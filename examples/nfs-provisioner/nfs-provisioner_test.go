@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestSafeJoin(t *testing.T) {
+	cases := []struct {
+		name    string
+		subPath string
+		wantErr bool
+	}{
+		{name: "plain nested path", subPath: "ns/pvc-1-pv-1"},
+		{name: "empty subPath resolves to mp itself", subPath: ""},
+		{name: "dot-dot escaping the export root", subPath: "../../../etc/cron.d/evil", wantErr: true},
+		{name: "dot-dot that stays within the export root", subPath: "ns/../ns2/pv-1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			joined, err := safeJoin("/persistentvolumes/server1", c.subPath)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("safeJoin(%q): got err=%v, wantErr=%v", c.subPath, err, c.wantErr)
+			}
+			if err == nil && !strings.HasPrefix(joined, "/persistentvolumes/server1") {
+				t.Errorf("safeJoin(%q): result %q escaped the export root", c.subPath, joined)
+			}
+		})
+	}
+}
+
+func TestDisposeVolumeDir(t *testing.T) {
+	cases := []struct {
+		name          string
+		reclaimPolicy v1.PersistentVolumeReclaimPolicy
+		onDelete      string
+		wantDirGone   bool
+		wantFileGone  bool
+		wantArchived  bool
+	}{
+		{
+			name:          "delete removes the pv directory",
+			reclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			onDelete:      onDeleteDelete,
+			wantDirGone:   true,
+		},
+		{
+			name:          "onDelete retain keeps the pv directory untouched",
+			reclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			onDelete:      onDeleteRetain,
+			wantDirGone:   false,
+			wantFileGone:  false,
+		},
+		{
+			name:          "onDelete archive renames the pv directory",
+			reclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			onDelete:      onDeleteArchive,
+			wantDirGone:   true,
+			wantArchived:  true,
+		},
+		{
+			name:          "recycle empties the directory but keeps it",
+			reclaimPolicy: v1.PersistentVolumeReclaimRecycle,
+			onDelete:      onDeleteDelete,
+			wantDirGone:   false,
+			wantFileGone:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "nfs-provisioner-test")
+			if err != nil {
+				t.Fatalf("TempDir: %v", err)
+			}
+			defer os.RemoveAll(root)
+
+			pvDir := filepath.Join(root, "pvc-123")
+			if err := os.MkdirAll(pvDir, 0777); err != nil {
+				t.Fatalf("MkdirAll: %v", err)
+			}
+			dataFile := filepath.Join(pvDir, "data")
+			if err := ioutil.WriteFile(dataFile, []byte("hello"), 0666); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+
+			siblingDir := filepath.Join(root, "pvc-456")
+			if err := os.MkdirAll(siblingDir, 0777); err != nil {
+				t.Fatalf("MkdirAll sibling: %v", err)
+			}
+
+			if err := disposeVolumeDir(c.reclaimPolicy, c.onDelete, defaultArchivePrefix, pvDir); err != nil {
+				t.Fatalf("disposeVolumeDir: unexpected error: %v", err)
+			}
+
+			if _, err := os.Stat(siblingDir); err != nil {
+				t.Errorf("sibling directory was affected: %v", err)
+			}
+
+			_, statErr := os.Stat(pvDir)
+			dirGone := os.IsNotExist(statErr)
+			if dirGone != c.wantDirGone {
+				t.Errorf("pv directory gone=%v, want %v", dirGone, c.wantDirGone)
+			}
+
+			if !dirGone {
+				_, fileErr := os.Stat(dataFile)
+				fileGone := os.IsNotExist(fileErr)
+				if fileGone != c.wantFileGone {
+					t.Errorf("data file gone=%v, want %v", fileGone, c.wantFileGone)
+				}
+			}
+
+			if c.wantArchived {
+				matches, err := filepath.Glob(filepath.Join(root, defaultArchivePrefix+"-*-pvc-123"))
+				if err != nil {
+					t.Fatalf("Glob: %v", err)
+				}
+				if len(matches) != 1 {
+					t.Errorf("expected exactly one archived directory, got %v", matches)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	glog "k8s.io/klog"
+)
+
+const (
+	quotaNone       = "none"
+	quotaXFSProject = "xfs_project"
+	quotaFake       = "fake"
+
+	// nfsProvisionerProjectID records the xfs_project project id allocated
+	// to a PV, so Delete() can release it without having to re-derive it.
+	nfsProvisionerProjectID = "nfsProvisionerProjectID"
+
+	// fakeQuotaPollInterval is how often the fake enforcer re-checks usage
+	// with du. It's deliberately coarse: du walks the whole subtree.
+	fakeQuotaPollInterval = 30 * time.Second
+)
+
+// cmdRunner abstracts running an external command so quota enforcement can
+// be unit tested without root or a real XFS filesystem.
+type cmdRunner interface {
+	Run(name string, arg ...string) ([]byte, error)
+}
+
+type execCmdRunner struct{}
+
+func (execCmdRunner) Run(name string, arg ...string) ([]byte, error) {
+	return exec.Command(name, arg...).CombinedOutput()
+}
+
+// quotaEnforcer allocates and releases whatever mechanism backs the `quota`
+// StorageClass parameter. mp is the NFS export's actual mountpoint (the
+// filesystem xfs_quota's commands must operate on); path is the directory a
+// PV was provisioned into, which may be a subdirectory of mp. id is an
+// opaque, backend-specific identifier persisted as a PV annotation so
+// Release can find it again later.
+type quotaEnforcer interface {
+	Enforce(mp string, path string, limit resource.Quantity) (id string, err error)
+	Release(mp string, path string, id string) error
+}
+
+func newQuotaEnforcer(kind string, runner cmdRunner) (quotaEnforcer, error) {
+	switch kind {
+	case "", quotaNone:
+		return noneEnforcer{}, nil
+	case quotaXFSProject:
+		return &xfsProjectEnforcer{runner: runner}, nil
+	case quotaFake:
+		e := newFakeEnforcer()
+		e.runner = runner
+		return e, nil
+	default:
+		return nil, fmt.Errorf("invalid quota parameter %q: must be one of %s, %s, %s", kind, quotaNone, quotaXFSProject, quotaFake)
+	}
+}
+
+// noneEnforcer is the default: no quota is enforced, matching historical
+// behavior.
+type noneEnforcer struct{}
+
+func (noneEnforcer) Enforce(mp string, path string, limit resource.Quantity) (string, error) {
+	return "", nil
+}
+func (noneEnforcer) Release(mp string, path string, id string) error { return nil }
+
+// xfsProjectEnforcer enforces PVC storage requests using XFS project quotas.
+// The NFS export's backing filesystem must be XFS and mounted with
+// `prjquota`/`pquota`; the provisioner must run privileged.
+type xfsProjectEnforcer struct {
+	runner cmdRunner
+
+	mu     sync.Mutex
+	nextID uint32
+}
+
+// Enforce assigns the next free project id to path and sets a hard block
+// limit equal to limit. The project id is returned so it can be stamped on
+// the PV and handed back to Release. mp must be the actual mounted
+// filesystem backing path (xfs_quota's last argument has to name a real
+// mount point from /proc/mounts, not an arbitrary directory beneath it).
+func (e *xfsProjectEnforcer) Enforce(mp string, path string, limit resource.Quantity) (string, error) {
+	e.mu.Lock()
+	if e.nextID == 0 {
+		e.nextID = 1000
+	}
+	e.nextID++
+	id := e.nextID
+	e.mu.Unlock()
+
+	projectSpec := fmt.Sprintf("%d:%s", id, path)
+	if out, err := e.runner.Run("xfs_quota", "-x", "-c", fmt.Sprintf("project -s -p %s %d", path, id), mp); err != nil {
+		return "", fmt.Errorf("unable to set xfs project %s: %v (%s)", projectSpec, err, out)
+	}
+	limitSpec := fmt.Sprintf("limit -p bhard=%d %d", limit.Value(), id)
+	if out, err := e.runner.Run("xfs_quota", "-x", "-c", limitSpec, mp); err != nil {
+		return "", fmt.Errorf("unable to set xfs quota for project %d: %v (%s)", id, err, out)
+	}
+
+	return fmt.Sprintf("%d", id), nil
+}
+
+// Release clears the hard block limit for id. The project<->path mapping
+// itself is left in place; xfs_quota has no "forget project" verb and a
+// stale mapping pointing at a deleted directory is harmless.
+func (e *xfsProjectEnforcer) Release(mp string, path string, id string) error {
+	limitSpec := fmt.Sprintf("limit -p bhard=0 %s", id)
+	if out, err := e.runner.Run("xfs_quota", "-x", "-c", limitSpec, mp); err != nil {
+		return fmt.Errorf("unable to release xfs quota for project %s: %v (%s)", id, err, out)
+	}
+	return nil
+}
+
+// reconcileXFSProjectIDs returns the highest xfs_project id already stamped
+// on an existing PV, so a freshly created xfsProjectEnforcer doesn't restart
+// counting from 1000 after a provisioner restart and hand out an id that's
+// still bound to a live PV (which would silently rebind - and corrupt - that
+// PV's quota).
+func reconcileXFSProjectIDs(client kubernetes.Interface) (uint32, error) {
+	pvs, err := client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("unable to list PVs to reconcile xfs_project ids: %v", err)
+	}
+	var maxID uint32
+	for _, pv := range pvs.Items {
+		if pv.Annotations[nfsProvisionerQuota] != quotaXFSProject {
+			continue
+		}
+		id, err := strconv.ParseUint(pv.Annotations[nfsProvisionerProjectID], 10, 32)
+		if err != nil {
+			continue
+		}
+		if uint32(id) > maxID {
+			maxID = uint32(id)
+		}
+	}
+	return maxID, nil
+}
+
+// fakeEnforcer has no kernel-level backing: it periodically shells out to
+// `du` and logs once the directory exceeds its request, for environments
+// (and tests) where project quotas aren't available. It does not actually
+// prevent writes past the limit.
+type fakeEnforcer struct {
+	runner cmdRunner
+
+	mu    sync.Mutex
+	stops map[string]chan struct{}
+}
+
+func newFakeEnforcer() *fakeEnforcer {
+	return &fakeEnforcer{runner: execCmdRunner{}, stops: map[string]chan struct{}{}}
+}
+
+func (e *fakeEnforcer) Enforce(mp string, path string, limit resource.Quantity) (string, error) {
+	stop := make(chan struct{})
+	e.mu.Lock()
+	e.stops[path] = stop
+	e.mu.Unlock()
+
+	go e.poll(path, limit, stop)
+
+	return path, nil
+}
+
+func (e *fakeEnforcer) Release(mp string, path string, id string) error {
+	e.mu.Lock()
+	stop, ok := e.stops[path]
+	delete(e.stops, path)
+	e.mu.Unlock()
+	if ok {
+		close(stop)
+	}
+	return nil
+}
+
+func (e *fakeEnforcer) poll(path string, limit resource.Quantity, stop chan struct{}) {
+	ticker := time.NewTicker(fakeQuotaPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			full, err := e.usageExceeds(path, limit)
+			if err != nil {
+				glog.Errorf("fake quota: unable to check usage of %s: %v", path, err)
+				continue
+			}
+			if full {
+				glog.Warningf("fake quota: %s has exceeded its requested capacity of %s", path, limit.String())
+			}
+		}
+	}
+}
+
+// usageExceeds shells out to `du -sb` to get the directory's current size
+// in bytes and compares it against limit.
+func (e *fakeEnforcer) usageExceeds(path string, limit resource.Quantity) (bool, error) {
+	out, err := e.runner.Run("du", "-sb", path)
+	if err != nil {
+		return false, fmt.Errorf("du failed: %v (%s)", err, out)
+	}
+	var used int64
+	if _, err := fmt.Sscanf(string(out), "%d", &used); err != nil {
+		return false, fmt.Errorf("unable to parse du output %q: %v", out, err)
+	}
+	return used > limit.Value(), nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeCmdRunner records every invocation as its joined command line and
+// returns the same canned output ("ok") and err for every command, so tests
+// can assert on exactly what an enforcer shelled out to without touching a
+// real filesystem.
+type fakeCmdRunner struct {
+	calls []string
+	err   error
+}
+
+func (f *fakeCmdRunner) Run(name string, arg ...string) ([]byte, error) {
+	f.calls = append(f.calls, strings.Join(append([]string{name}, arg...), " "))
+	return []byte("ok"), f.err
+}
+
+func TestNewQuotaEnforcer(t *testing.T) {
+	runner := &fakeCmdRunner{}
+	cases := []struct {
+		kind    string
+		wantErr bool
+	}{
+		{"", false},
+		{quotaNone, false},
+		{quotaXFSProject, false},
+		{quotaFake, false},
+		{"bogus", true},
+	}
+	for _, c := range cases {
+		_, err := newQuotaEnforcer(c.kind, runner)
+		if (err != nil) != c.wantErr {
+			t.Errorf("newQuotaEnforcer(%q): got err=%v, wantErr=%v", c.kind, err, c.wantErr)
+		}
+	}
+}
+
+func TestXFSProjectEnforcer(t *testing.T) {
+	runner := &fakeCmdRunner{}
+	e := &xfsProjectEnforcer{runner: runner}
+	mp := "/persistentvolumes/server"
+	path := mp + "/vol1"
+
+	id, err := e.Enforce(mp, path, *resource.NewQuantity(1<<30, resource.BinarySI))
+	if err != nil {
+		t.Fatalf("Enforce: unexpected error: %v", err)
+	}
+	if id == "" {
+		t.Fatalf("Enforce: expected a non-empty project id")
+	}
+	if len(runner.calls) != 2 {
+		t.Fatalf("Enforce: expected 2 xfs_quota invocations, got %d: %v", len(runner.calls), runner.calls)
+	}
+	if !strings.Contains(runner.calls[0], "project -s -p") {
+		t.Errorf("Enforce: expected a project-set call, got %q", runner.calls[0])
+	}
+	if !strings.HasSuffix(runner.calls[0], mp) {
+		t.Errorf("Enforce: expected the project-set call to target the mountpoint %q, got %q", mp, runner.calls[0])
+	}
+	if !strings.Contains(runner.calls[1], fmt.Sprintf("bhard=%d", int64(1<<30))) {
+		t.Errorf("Enforce: expected a bhard limit call, got %q", runner.calls[1])
+	}
+
+	if err := e.Release(mp, path, id); err != nil {
+		t.Fatalf("Release: unexpected error: %v", err)
+	}
+	if len(runner.calls) != 3 || !strings.Contains(runner.calls[2], "bhard=0") {
+		t.Errorf("Release: expected a bhard=0 call, got %v", runner.calls)
+	}
+	if !strings.HasSuffix(runner.calls[2], mp) {
+		t.Errorf("Release: expected the release call to target the mountpoint %q, got %q", mp, runner.calls[2])
+	}
+}
+
+func TestXFSProjectEnforcerAllocatesDistinctIDs(t *testing.T) {
+	runner := &fakeCmdRunner{}
+	e := &xfsProjectEnforcer{runner: runner}
+	mp := "/persistentvolumes/server"
+
+	id1, err := e.Enforce(mp, mp+"/vol1", *resource.NewQuantity(1<<20, resource.BinarySI))
+	if err != nil {
+		t.Fatalf("Enforce: unexpected error: %v", err)
+	}
+	id2, err := e.Enforce(mp, mp+"/vol2", *resource.NewQuantity(1<<20, resource.BinarySI))
+	if err != nil {
+		t.Fatalf("Enforce: unexpected error: %v", err)
+	}
+	if id1 == id2 {
+		t.Errorf("expected distinct project ids, got %q twice", id1)
+	}
+}
+
+func TestXFSProjectEnforcerPropagatesCommandError(t *testing.T) {
+	runner := &fakeCmdRunner{err: fmt.Errorf("boom")}
+	e := &xfsProjectEnforcer{runner: runner}
+	mp := "/persistentvolumes/server"
+
+	if _, err := e.Enforce(mp, mp+"/vol1", *resource.NewQuantity(1<<20, resource.BinarySI)); err == nil {
+		t.Fatal("expected Enforce to propagate the xfs_quota failure")
+	}
+}
+
+func TestReconcileXFSProjectIDs(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "pv-1",
+				Annotations: map[string]string{
+					nfsProvisionerQuota:     quotaXFSProject,
+					nfsProvisionerProjectID: "1042",
+				},
+			},
+		},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "pv-2",
+				Annotations: map[string]string{
+					nfsProvisionerQuota:     quotaXFSProject,
+					nfsProvisionerProjectID: "1007",
+				},
+			},
+		},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "pv-3",
+				Annotations: map[string]string{
+					// Not an xfs_project PV: its id must not factor into the max.
+					nfsProvisionerQuota:     quotaFake,
+					nfsProvisionerProjectID: "9999",
+				},
+			},
+		},
+	)
+
+	maxID, err := reconcileXFSProjectIDs(client)
+	if err != nil {
+		t.Fatalf("reconcileXFSProjectIDs: unexpected error: %v", err)
+	}
+	if maxID != 1042 {
+		t.Errorf("reconcileXFSProjectIDs: got %d, want 1042", maxID)
+	}
+}
+
+func TestNFSProvisionerQuotaEnforcerForReconcilesXFSProjectIDs(t *testing.T) {
+	runner := &fakeCmdRunner{}
+	client := fake.NewSimpleClientset(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pv-1",
+			Annotations: map[string]string{
+				nfsProvisionerQuota:     quotaXFSProject,
+				nfsProvisionerProjectID: "5000",
+			},
+		},
+	})
+	p := &nfsProvisioner{client: client, quotaRunner: runner}
+
+	e, err := p.quotaEnforcerFor(quotaXFSProject)
+	if err != nil {
+		t.Fatalf("quotaEnforcerFor: unexpected error: %v", err)
+	}
+	mp := "/persistentvolumes/server"
+	id, err := e.Enforce(mp, mp+"/vol1", *resource.NewQuantity(1<<20, resource.BinarySI))
+	if err != nil {
+		t.Fatalf("Enforce: unexpected error: %v", err)
+	}
+	if id != "5001" {
+		t.Errorf("Enforce: got project id %q after a restart, want %q (the id after the highest already allocated)", id, "5001")
+	}
+}
+
+func TestFakeEnforcerUsageExceeds(t *testing.T) {
+	runner := &fakeCmdRunner{}
+	e := &fakeEnforcer{runner: runner, stops: map[string]chan struct{}{}}
+
+	runner.calls = nil
+	// fakeCmdRunner always returns "ok", which doesn't parse as a du size,
+	// so usageExceeds must surface the parse failure rather than silently
+	// reporting the directory as within bounds.
+	if _, err := e.usageExceeds("/persistentvolumes/server/vol1", *resource.NewQuantity(100, resource.BinarySI)); err == nil {
+		t.Errorf("usageExceeds: expected an error for unparsable du output")
+	}
+}
+
+func TestNFSProvisionerQuotaEnforcerForReusesBackendState(t *testing.T) {
+	runner := &fakeCmdRunner{}
+	p := &nfsProvisioner{client: fake.NewSimpleClientset(), quotaRunner: runner}
+	mp := "/persistentvolumes/server"
+
+	// xfs_project: Provision calls quotaEnforcerFor once per PV, so distinct
+	// PVs must land on distinct project ids rather than each restarting
+	// xfsProjectEnforcer.nextID from zero.
+	e1, err := p.quotaEnforcerFor(quotaXFSProject)
+	if err != nil {
+		t.Fatalf("quotaEnforcerFor(%q): unexpected error: %v", quotaXFSProject, err)
+	}
+	id1, err := e1.Enforce(mp, mp+"/vol1", *resource.NewQuantity(1<<20, resource.BinarySI))
+	if err != nil {
+		t.Fatalf("Enforce: unexpected error: %v", err)
+	}
+	e2, err := p.quotaEnforcerFor(quotaXFSProject)
+	if err != nil {
+		t.Fatalf("quotaEnforcerFor(%q): unexpected error: %v", quotaXFSProject, err)
+	}
+	id2, err := e2.Enforce(mp, mp+"/vol2", *resource.NewQuantity(1<<20, resource.BinarySI))
+	if err != nil {
+		t.Fatalf("Enforce: unexpected error: %v", err)
+	}
+	if id1 == id2 {
+		t.Errorf("quotaEnforcerFor: expected distinct project ids across Provision calls, got %q twice", id1)
+	}
+
+	// fake: Delete must see the same enforcer (and its stops map) that
+	// Provision used, or Release can never find the polling goroutine to stop.
+	fe1, err := p.quotaEnforcerFor(quotaFake)
+	if err != nil {
+		t.Fatalf("quotaEnforcerFor(%q): unexpected error: %v", quotaFake, err)
+	}
+	path := "/persistentvolumes/server/vol3"
+	id, err := fe1.Enforce(mp, path, *resource.NewQuantity(1<<20, resource.BinarySI))
+	if err != nil {
+		t.Fatalf("Enforce: unexpected error: %v", err)
+	}
+	fe2, err := p.quotaEnforcerFor(quotaFake)
+	if err != nil {
+		t.Fatalf("quotaEnforcerFor(%q): unexpected error: %v", quotaFake, err)
+	}
+	if fe1 != fe2 {
+		t.Fatalf("quotaEnforcerFor(%q): expected the same enforcer instance across calls", quotaFake)
+	}
+	if err := fe2.Release(mp, path, id); err != nil {
+		t.Fatalf("Release: unexpected error: %v", err)
+	}
+	if _, ok := fe2.(*fakeEnforcer).stops[path]; ok {
+		t.Errorf("Release: expected polling goroutine to be untracked after release")
+	}
+}
+
+func TestFakeEnforcerReleaseStopsPolling(t *testing.T) {
+	runner := &fakeCmdRunner{}
+	e := newFakeEnforcer()
+	e.runner = runner
+
+	id, err := e.Enforce("/persistentvolumes/server", "/persistentvolumes/server/vol1", *resource.NewQuantity(1<<20, resource.BinarySI))
+	if err != nil {
+		t.Fatalf("Enforce: unexpected error: %v", err)
+	}
+	if err := e.Release("/persistentvolumes/server", "/persistentvolumes/server/vol1", id); err != nil {
+		t.Fatalf("Release: unexpected error: %v", err)
+	}
+	if _, ok := e.stops["/persistentvolumes/server/vol1"]; ok {
+		t.Errorf("Release: expected polling goroutine to be untracked after release")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/controller"
+)
+
+const (
+	// zoneLabel/zoneLabelBeta are checked in order so clusters that still
+	// carry only the deprecated beta topology labels keep working.
+	zoneLabel     = "topology.kubernetes.io/zone"
+	zoneLabelBeta = "failure-domain.beta.kubernetes.io/zone"
+
+	// readWriteOncePod is v1.PersistentVolumeAccessMode("ReadWriteOncePod")
+	// spelled out as a literal rather than referenced as v1.ReadWriteOncePod:
+	// that constant wasn't added until k8s.io/api v0.22, newer than the
+	// v0.19.1 this repo is pinned to. PersistentVolumeAccessMode is just a
+	// string, so the literal still round-trips correctly against any PVC
+	// actually requesting the mode.
+	readWriteOncePod = v1.PersistentVolumeAccessMode("ReadWriteOncePod")
+
+	// readWriteOncePodMinMinor is the first Kubernetes 1.x minor version that
+	// understands the ReadWriteOncePod access mode (it shipped as alpha in
+	// 1.22). Requesting it against an older apiserver would silently behave
+	// like ReadWriteOnce, so Provision rejects it outright instead.
+	readWriteOncePodMinMinor = 22
+)
+
+// resolveServerAndPath picks the NFS server/export path to provision
+// against. For an immediately-bound StorageClass this is just the
+// nfsServer/nfsPath parameters. For a WaitForFirstConsumer StorageClass it
+// instead picks, from the parallel nfsServers/nfsPaths parameter lists, the
+// entry whose zone (nfsZones) matches the zone of options.SelectedNode -
+// letting one Deployment serve NFS servers local to each zone of a
+// multi-zone cluster.
+func resolveServerAndPath(options controller.ProvisionOptions) (server string, path string, err error) {
+	params := options.StorageClass.Parameters
+	if options.StorageClass.VolumeBindingMode == nil || *options.StorageClass.VolumeBindingMode != storagev1.VolumeBindingWaitForFirstConsumer {
+		if !(inMap("nfsPath", params) && inMap("nfsServer", params)) {
+			return "", "", fmt.Errorf("nfsPath and nfsServer parameters required")
+		}
+		return params["nfsServer"], params["nfsPath"], nil
+	}
+
+	if options.SelectedNode == nil {
+		return "", "", fmt.Errorf("WaitForFirstConsumer StorageClass requires a selected node")
+	}
+	servers := splitParam(params["nfsServers"])
+	paths := splitParam(params["nfsPaths"])
+	zones := splitParam(params["nfsZones"])
+	if len(servers) == 0 || len(servers) != len(paths) || len(servers) != len(zones) {
+		return "", "", fmt.Errorf("nfsServers, nfsPaths and nfsZones parameters must be set to equal-length, comma-separated lists for WaitForFirstConsumer StorageClasses")
+	}
+
+	zone := nodeZone(options.SelectedNode)
+	if zone == "" {
+		return "", "", fmt.Errorf("selected node %s has no %s/%s label", options.SelectedNode.Name, zoneLabel, zoneLabelBeta)
+	}
+	for i, z := range zones {
+		if z == zone {
+			return servers[i], paths[i], nil
+		}
+	}
+	return "", "", fmt.Errorf("no nfsServers entry has a zone matching selected node %s's zone %q", options.SelectedNode.Name, zone)
+}
+
+func splitParam(v string) []string {
+	if v == "" {
+		return nil
+	}
+	parts := strings.Split(v, ",")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+	}
+	return parts
+}
+
+func nodeZone(node *v1.Node) string {
+	if z := node.Labels[zoneLabel]; z != "" {
+		return z
+	}
+	return node.Labels[zoneLabelBeta]
+}
+
+// volumeNodeAffinity builds the PV's node affinity for a delayed-binding
+// PV. It mirrors the StorageClass's AllowedTopologies when present, falling
+// back to pinning the PV to the selected node's own zone.
+func volumeNodeAffinity(options controller.ProvisionOptions) *v1.VolumeNodeAffinity {
+	if options.SelectedNode == nil {
+		return nil
+	}
+	if len(options.StorageClass.AllowedTopologies) > 0 {
+		terms := make([]v1.NodeSelectorTerm, 0, len(options.StorageClass.AllowedTopologies))
+		for _, topo := range options.StorageClass.AllowedTopologies {
+			var exprs []v1.NodeSelectorRequirement
+			for _, exp := range topo.MatchLabelExpressions {
+				exprs = append(exprs, v1.NodeSelectorRequirement{
+					Key:      exp.Key,
+					Operator: v1.NodeSelectorOpIn,
+					Values:   exp.Values,
+				})
+			}
+			terms = append(terms, v1.NodeSelectorTerm{MatchExpressions: exprs})
+		}
+		return &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: terms}}
+	}
+
+	zone := nodeZone(options.SelectedNode)
+	if zone == "" {
+		return nil
+	}
+	return &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{{
+				MatchExpressions: []v1.NodeSelectorRequirement{{
+					Key:      zoneLabel,
+					Operator: v1.NodeSelectorOpIn,
+					Values:   []string{zone},
+				}},
+			}},
+		},
+	}
+}
+
+// parseMinorVersion extracts the leading integer from a server version's
+// Minor field, which the apiserver sometimes suffixes with "+" (e.g. "21+"
+// on some GKE builds).
+func parseMinorVersion(minor string) int {
+	minor = strings.TrimRight(minor, "+")
+	n, err := strconv.Atoi(minor)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// validateAccessModes rejects ReadWriteOncePod requests against clusters
+// too old to understand it (it shipped as alpha in Kubernetes 1.22); such
+// clusters would otherwise silently treat it as ReadWriteOnce.
+func validateAccessModes(accessModes []v1.PersistentVolumeAccessMode, serverMinor int) error {
+	for _, mode := range accessModes {
+		if mode == readWriteOncePod && serverMinor < readWriteOncePodMinMinor {
+			return fmt.Errorf("ReadWriteOncePod requires Kubernetes 1.%d+, server is 1.%d", readWriteOncePodMinMinor, serverMinor)
+		}
+	}
+	return nil
+}
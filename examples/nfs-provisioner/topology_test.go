@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestValidateAccessModes(t *testing.T) {
+	cases := []struct {
+		name        string
+		accessModes []v1.PersistentVolumeAccessMode
+		serverMinor int
+		wantErr     bool
+	}{
+		{
+			name:        "ReadWriteOnce is always allowed",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			serverMinor: 18,
+		},
+		{
+			name:        "ReadWriteOncePod on a new enough server",
+			accessModes: []v1.PersistentVolumeAccessMode{readWriteOncePod},
+			serverMinor: 22,
+		},
+		{
+			name:        "ReadWriteOncePod on an older server is rejected",
+			accessModes: []v1.PersistentVolumeAccessMode{readWriteOncePod},
+			serverMinor: 21,
+			wantErr:     true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateAccessModes(c.accessModes, c.serverMinor)
+			if (err != nil) != c.wantErr {
+				t.Errorf("validateAccessModes(%v, %d): got err=%v, wantErr=%v", c.accessModes, c.serverMinor, err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseMinorVersion(t *testing.T) {
+	cases := []struct {
+		minor string
+		want  int
+	}{
+		{"22", 22},
+		{"21+", 21},
+		{"bogus", 0},
+	}
+	for _, c := range cases {
+		if got := parseMinorVersion(c.minor); got != c.want {
+			t.Errorf("parseMinorVersion(%q) = %d, want %d", c.minor, got, c.want)
+		}
+	}
+}